@@ -0,0 +1,215 @@
+package consensus
+
+import (
+	"encoding/binary"
+	"errors"
+
+	"github.com/boltdb/bolt"
+
+	"github.com/NebulousLabs/Sia/encoding"
+	"github.com/NebulousLabs/Sia/modules"
+)
+
+// ChangeLog is the bucket that stores every change record ever committed,
+// keyed by its ChangeID in big-endian order so that a bolt cursor can seek
+// directly to a subscriber's last acknowledged position.
+var ChangeLog = []byte("ChangeLog")
+
+var errChangeIDNotFound = errors.New("requested change id is not present in the change log, subscriber must resync from genesis")
+
+// ChangeID uniquely identifies a committed changeEntry. IDs are assigned
+// sequentially starting at 1, leaving 0 free for callers to mean "replay
+// the entire change log from genesis".
+type ChangeID uint64
+
+// changeEntry is the durable record of a single commitDiffSet call. It
+// carries every diff that was applied or reverted so that a persistent
+// subscriber can replay it without consulting the processedBlock it was
+// generated from.
+type changeEntry struct {
+	ID                        ChangeID
+	Direction                 modules.DiffDirection
+	SiacoinOutputDiffs        []modules.SiacoinOutputDiff
+	FileContractDiffs         []modules.FileContractDiff
+	SiafundOutputDiffs        []modules.SiafundOutputDiff
+	DelayedSiacoinOutputDiffs []modules.DelayedSiacoinOutputDiff
+	SiafundPoolDiffs          []modules.SiafundPoolDiff
+}
+
+// changeIDKey encodes a ChangeID as a ChangeLog bucket key.
+func changeIDKey(id ChangeID) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, uint64(id))
+	return key
+}
+
+// changeLogBucket returns the ChangeLog bucket, creating it the first time
+// a change is ever committed. It must only be called from within a
+// read-write transaction; every call site in this file is reached through
+// cs.commitUpdate in commitNodeDiffs or generateAndApplyDiff, which
+// guarantees that.
+func changeLogBucket(tx *bolt.Tx) (*bolt.Bucket, error) {
+	return tx.CreateBucketIfNotExists(ChangeLog)
+}
+
+// nextChangeID returns the ChangeID that should be assigned to the next
+// change record, derived from the highest key currently present in b.
+func nextChangeID(b *bolt.Bucket) ChangeID {
+	k, _ := b.Cursor().Last()
+	if k == nil {
+		return 1
+	}
+	return ChangeID(binary.BigEndian.Uint64(k)) + 1
+}
+
+// appendChangeEntry assigns the next ChangeID to ce and durably records it,
+// writing the assigned ID back into *ce so the caller can track it (e.g. to
+// advance a subscriber's cursor once the commit succeeds). Callers are
+// expected to invoke this from within the same bolt transaction that
+// commits the diffs ce describes, so that the change log can never
+// disagree with the consensus set it documents.
+func appendChangeEntry(tx *bolt.Tx, ce *changeEntry) error {
+	b, err := changeLogBucket(tx)
+	if err != nil {
+		return err
+	}
+	ce.ID = nextChangeID(b)
+	return b.Put(changeIDKey(ce.ID), encoding.Marshal(*ce))
+}
+
+// pruneChangeLog deletes every change record older than oldestCursor, the
+// lowest cursor (the last ChangeID recorded for a subscriber) of any live
+// persistent subscriber. The record at oldestCursor itself is kept, since
+// ConsensusSetPersistentSubscribe needs it present to resume from it. An
+// oldestCursor of 0 means there are no persistent
+// subscribers to protect, and nothing is pruned. This is called from the
+// same transaction as appendChangeEntry so the append and the prune either
+// both happen or neither does.
+func pruneChangeLog(tx *bolt.Tx, oldestCursor ChangeID) error {
+	if oldestCursor == 0 {
+		return nil
+	}
+	b, err := changeLogBucket(tx)
+	if err != nil {
+		return err
+	}
+	c := b.Cursor()
+	for k, _ := c.First(); k != nil; k, _ = c.Next() {
+		if ChangeID(binary.BigEndian.Uint64(k)) >= oldestCursor {
+			break
+		}
+		if err := b.Delete(k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// changeEntryConsensusChange converts a durable changeEntry back into the
+// modules.ConsensusChange shape that subscribers expect, regardless of
+// whether it is being replayed from ChangeLog or delivered live.
+func changeEntryConsensusChange(ce changeEntry) modules.ConsensusChange {
+	cc := modules.ConsensusChange{
+		SiacoinOutputDiffs:        ce.SiacoinOutputDiffs,
+		FileContractDiffs:         ce.FileContractDiffs,
+		SiafundOutputDiffs:        ce.SiafundOutputDiffs,
+		DelayedSiacoinOutputDiffs: ce.DelayedSiacoinOutputDiffs,
+		SiafundPoolDiffs:          ce.SiafundPoolDiffs,
+	}
+	return cc
+}
+
+// updatePersistentCursors advances every registered persistent
+// subscriber's cursor to ce.ID now that ce has been durably committed.
+// Without this, oldestPersistentCursor would stay pinned at each
+// subscriber's join-time position forever, and pruneChangeLog would never
+// make progress once a long-running subscriber is attached - exactly the
+// steady-state case the prune policy exists to bound. It is called once
+// per commit, as soon as that commit succeeds; it does not wait for the
+// live ConsensusChange to be delivered to any subscriber.
+func (cs *ConsensusSet) updatePersistentCursors(ce changeEntry) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	for subscriber := range cs.persistentCursors {
+		cs.persistentCursors[subscriber] = ce.ID
+	}
+}
+
+// oldestPersistentCursor returns the lowest cursor (the last ChangeID
+// recorded for a subscriber) among the registered persistent subscribers,
+// or 0 if there are none.
+func (cs *ConsensusSet) oldestPersistentCursor() ChangeID {
+	cs.mu.RLock()
+	defer cs.mu.RUnlock()
+	var oldest ChangeID
+	for _, cursor := range cs.persistentCursors {
+		if oldest == 0 || cursor < oldest {
+			oldest = cursor
+		}
+	}
+	return oldest
+}
+
+// ConsensusSetPersistentSubscribe adds subscriber to the list of
+// subscribers, replays every change recorded since lastChangeID, and then
+// begins synchronously delivering new changes as they are committed. A
+// lastChangeID of 0 replays the entire change log from genesis. Unlike
+// ConsensusSetSubscribe, the subscriber does not need to stay connected for
+// the lifetime of the consensus set - so long as lastChangeID is still
+// present in ChangeLog, a subscriber that crashed or disconnected can
+// resume from exactly where it left off instead of rescanning from
+// genesis.
+func (cs *ConsensusSet) ConsensusSetPersistentSubscribe(subscriber modules.ConsensusSetSubscriber, lastChangeID ChangeID) error {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	var entries []changeEntry
+	err := cs.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(ChangeLog)
+		if b == nil {
+			// No change has ever been committed yet (e.g. subscribing
+			// before the genesis block is processed). Nothing to replay.
+			if lastChangeID != 0 {
+				return errChangeIDNotFound
+			}
+			return nil
+		}
+		if lastChangeID != 0 && b.Get(changeIDKey(lastChangeID)) == nil {
+			return errChangeIDNotFound
+		}
+		c := b.Cursor()
+		var k, v []byte
+		if lastChangeID == 0 {
+			k, v = c.First()
+		} else {
+			c.Seek(changeIDKey(lastChangeID))
+			k, v = c.Next()
+		}
+		for ; k != nil; k, v = c.Next() {
+			var ce changeEntry
+			if err := encoding.Unmarshal(v, &ce); err != nil {
+				return err
+			}
+			entries = append(entries, ce)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, ce := range entries {
+		subscriber.ProcessConsensusChange(changeEntryConsensusChange(ce))
+	}
+
+	cursor := lastChangeID
+	if len(entries) > 0 {
+		cursor = entries[len(entries)-1].ID
+	}
+	if cs.persistentCursors == nil {
+		cs.persistentCursors = make(map[modules.ConsensusSetSubscriber]ChangeID)
+	}
+	cs.persistentCursors[subscriber] = cursor
+	cs.subscribers = append(cs.subscribers, subscriber)
+	return nil
+}
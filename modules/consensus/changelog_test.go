@@ -0,0 +1,153 @@
+package consensus
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/boltdb/bolt"
+
+	"github.com/NebulousLabs/Sia/modules"
+)
+
+// openChangeLogTestDB opens a fresh, empty bolt database for exercising
+// the ChangeLog helpers directly, without needing a full ConsensusSet.
+func openChangeLogTestDB(t *testing.T) *bolt.DB {
+	path := filepath.Join(t.TempDir(), "changelog.db")
+	db, err := bolt.Open(path, 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		db.Close()
+	})
+	return db
+}
+
+// TestAppendChangeEntryCreatesBucket verifies that appendChangeEntry works
+// against a brand new database where ChangeLog has never been created -
+// exactly the state commitNodeDiffs sees while committing the very first
+// block. Before this bucket was created lazily, this call panicked on a
+// nil *bolt.Bucket.
+func TestAppendChangeEntryCreatesBucket(t *testing.T) {
+	db := openChangeLogTestDB(t)
+	err := db.Update(func(tx *bolt.Tx) error {
+		ce := changeEntry{Direction: modules.DiffApply}
+		return appendChangeEntry(tx, &ce)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestAppendChangeEntrySequentialIDs verifies that ChangeIDs are assigned
+// sequentially starting at 1.
+func TestAppendChangeEntrySequentialIDs(t *testing.T) {
+	db := openChangeLogTestDB(t)
+	var ids []ChangeID
+	for i := 0; i < 3; i++ {
+		err := db.Update(func(tx *bolt.Tx) error {
+			ce := changeEntry{Direction: modules.DiffApply}
+			if err := appendChangeEntry(tx, &ce); err != nil {
+				return err
+			}
+			ids = append(ids, ce.ID)
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i, id := range ids {
+		if id != ChangeID(i+1) {
+			t.Fatalf("expected change %d to have ID %d, got %d", i, i+1, id)
+		}
+	}
+}
+
+// TestPruneChangeLog verifies that pruneChangeLog deletes every change
+// strictly older than its cursor, and keeps everything at or after it.
+func TestPruneChangeLog(t *testing.T) {
+	db := openChangeLogTestDB(t)
+	for i := 0; i < 5; i++ {
+		err := db.Update(func(tx *bolt.Tx) error {
+			ce := changeEntry{Direction: modules.DiffApply}
+			return appendChangeEntry(tx, &ce)
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err := db.Update(func(tx *bolt.Tx) error {
+		return pruneChangeLog(tx, 4)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(ChangeLog)
+		for i := ChangeID(1); i < 4; i++ {
+			if b.Get(changeIDKey(i)) != nil {
+				t.Errorf("change %d should have been pruned", i)
+			}
+		}
+		for i := ChangeID(4); i <= 5; i++ {
+			if b.Get(changeIDKey(i)) == nil {
+				t.Errorf("change %d should not have been pruned", i)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestPruneChangeLogNoCursor verifies that an oldestCursor of 0 (no
+// persistent subscribers registered) prunes nothing.
+func TestPruneChangeLogNoCursor(t *testing.T) {
+	db := openChangeLogTestDB(t)
+	err := db.Update(func(tx *bolt.Tx) error {
+		ce := changeEntry{Direction: modules.DiffApply}
+		if err := appendChangeEntry(tx, &ce); err != nil {
+			return err
+		}
+		return pruneChangeLog(tx, 0)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(ChangeLog)
+		if b.Get(changeIDKey(1)) == nil {
+			t.Error("change 1 should not have been pruned when oldestCursor is 0")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestUpdatePersistentCursorsAdvances verifies that
+// updatePersistentCursors moves every registered subscriber's cursor
+// forward to the delivered change's ID, not just at subscribe time.
+func TestUpdatePersistentCursorsAdvances(t *testing.T) {
+	cs := &ConsensusSet{
+		persistentCursors: map[modules.ConsensusSetSubscriber]ChangeID{
+			fakeSubscriber{}: 1,
+		},
+	}
+	cs.updatePersistentCursors(changeEntry{ID: 5})
+	if got := cs.oldestPersistentCursor(); got != 5 {
+		t.Fatalf("expected cursor to advance to 5, got %d", got)
+	}
+}
+
+// fakeSubscriber is a minimal modules.ConsensusSetSubscriber used only to
+// exercise cursor bookkeeping; it never needs to observe real changes.
+type fakeSubscriber struct{}
+
+func (fakeSubscriber) ProcessConsensusChange(cc modules.ConsensusChange) {}
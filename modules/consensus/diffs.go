@@ -1,6 +1,7 @@
 package consensus
 
 import (
+	"context"
 	"errors"
 
 	"github.com/boltdb/bolt"
@@ -37,40 +38,124 @@ var (
 	errWrongRevertDiffSet                = errors.New("reverting a diff set that isn't the current block")
 )
 
-// commitSiacoinOutputDiff applies or reverts a SiacoinOutputDiff.
-func commitSiacoinOutputDiff(tx *bolt.Tx, scod modules.SiacoinOutputDiff, dir modules.DiffDirection) error {
-	if scod.Direction == dir {
-		return addSiacoinOutput(tx, scod.ID, scod.SiacoinOutput)
+// commitSiacoinOutputDiff applies or reverts a SiacoinOutputDiff. tx is a
+// ConsensusDBTx rather than a *bolt.Tx so that a non-Bolt ConsensusDB
+// backend (see storage.go) can back this write too; against the default
+// Bolt backend it delegates to the existing addSiacoinOutput /
+// removeSiacoinOutput helpers so behavior is unchanged.
+func commitSiacoinOutputDiff(tx ConsensusDBTx, scod modules.SiacoinOutputDiff, dir modules.DiffDirection) error {
+	apply := scod.Direction == dir
+	if bt, ok := tx.(boltConsensusDBTx); ok {
+		if apply {
+			return addSiacoinOutput(bt.tx, scod.ID, scod.SiacoinOutput)
+		}
+		return removeSiacoinOutput(bt.tx, scod.ID)
+	}
+	b := tx.Bucket(SiacoinOutputs)
+	if apply {
+		return b.Put(scod.ID[:], encoding.Marshal(scod.SiacoinOutput))
+	}
+	return b.Delete(scod.ID[:])
+}
+
+// commitFileContractDiff applies or reverts a FileContractDiff. See
+// commitSiacoinOutputDiff for why tx is a ConsensusDBTx.
+func commitFileContractDiff(tx ConsensusDBTx, fcd modules.FileContractDiff, dir modules.DiffDirection) error {
+	apply := fcd.Direction == dir
+	if bt, ok := tx.(boltConsensusDBTx); ok {
+		if apply {
+			return addFileContract(bt.tx, fcd.ID, fcd.FileContract)
+		}
+		return removeFileContract(bt.tx, fcd.ID)
+	}
+	b := tx.Bucket(FileContracts)
+	if apply {
+		return b.Put(fcd.ID[:], encoding.Marshal(fcd.FileContract))
+	}
+	return b.Delete(fcd.ID[:])
+}
+
+// commitSiafundOutputDiff applies or reverts a Siafund output diff. See
+// commitSiacoinOutputDiff for why tx is a ConsensusDBTx.
+func commitSiafundOutputDiff(tx ConsensusDBTx, sfod modules.SiafundOutputDiff, dir modules.DiffDirection) error {
+	apply := sfod.Direction == dir
+	if bt, ok := tx.(boltConsensusDBTx); ok {
+		if apply {
+			return addSiafundOutput(bt.tx, sfod.ID, sfod.SiafundOutput)
+		}
+		return removeSiafundOutput(bt.tx, sfod.ID)
 	}
-	return removeSiacoinOutput(tx, scod.ID)
+	b := tx.Bucket(SiafundOutputs)
+	if apply {
+		return b.Put(sfod.ID[:], encoding.Marshal(sfod.SiafundOutput))
+	}
+	return b.Delete(sfod.ID[:])
+}
+
+// delayedSiacoinOutputKey builds the ConsensusDBBucket key a non-Bolt
+// backend stores a delayed siacoin output under. The Bolt backend instead
+// keeps one bucket per maturity height (see addDSCO/removeDSCO); a flat
+// ConsensusDBBucket has no equivalent notion of nested buckets, so height
+// and ID are folded into a single composite key instead.
+func delayedSiacoinOutputKey(height types.BlockHeight, id types.SiacoinOutputID) []byte {
+	key := make([]byte, 0, 8+len(id))
+	key = append(key, encoding.EncUint64(uint64(height))...)
+	key = append(key, id[:]...)
+	return key
 }
 
-// commitFileContractDiff applies or reverts a FileContractDiff.
-func commitFileContractDiff(tx *bolt.Tx, fcd modules.FileContractDiff, dir modules.DiffDirection) error {
-	if fcd.Direction == dir {
-		return addFileContract(tx, fcd.ID, fcd.FileContract)
+// commitDelayedSiacoinOutputDiff applies or reverts a
+// delayedSiacoinOutputDiff. See commitSiacoinOutputDiff for why tx is a
+// ConsensusDBTx.
+func commitDelayedSiacoinOutputDiff(tx ConsensusDBTx, dscod modules.DelayedSiacoinOutputDiff, dir modules.DiffDirection) error {
+	apply := dscod.Direction == dir
+	if bt, ok := tx.(boltConsensusDBTx); ok {
+		if apply {
+			return addDSCO(bt.tx, dscod.MaturityHeight, dscod.ID, dscod.SiacoinOutput)
+		}
+		return removeDSCO(bt.tx, dscod.MaturityHeight, dscod.ID)
+	}
+	b := tx.Bucket(nonBoltDelayedSiacoinOutputs)
+	key := delayedSiacoinOutputKey(dscod.MaturityHeight, dscod.ID)
+	if apply {
+		return b.Put(key, encoding.Marshal(dscod.SiacoinOutput))
 	}
-	return removeFileContract(tx, fcd.ID)
+	return b.Delete(key)
 }
 
-// commitSiafundOutputDiff applies or reverts a Siafund output diff.
-func commitSiafundOutputDiff(tx *bolt.Tx, sfod modules.SiafundOutputDiff, dir modules.DiffDirection) error {
-	if sfod.Direction == dir {
-		return addSiafundOutput(tx, sfod.ID, sfod.SiafundOutput)
+// nonBoltSiafundPoolKey is the single key a non-Bolt backend stores the
+// siafund pool value under, inside nonBoltSiafundPool. The Bolt backend
+// instead keeps the pool as a value read and written through
+// getSiafundPool/setSiafundPool.
+var nonBoltSiafundPoolKey = []byte("pool")
+
+// getSiafundPoolTx reads the current siafund pool through tx, regardless
+// of which ConsensusDB backend is in use.
+func getSiafundPoolTx(tx ConsensusDBTx) types.Currency {
+	if bt, ok := tx.(boltConsensusDBTx); ok {
+		return getSiafundPool(bt.tx)
 	}
-	return removeSiafundOutput(tx, sfod.ID)
+	v := tx.Bucket(nonBoltSiafundPool).Get(nonBoltSiafundPoolKey)
+	var pool types.Currency
+	if v != nil {
+		encoding.Unmarshal(v, &pool)
+	}
+	return pool
 }
 
-// commitDelayedSiacoinOutputDiff applies or reverts a delayedSiacoinOutputDiff.
-func commitDelayedSiacoinOutputDiff(tx *bolt.Tx, dscod modules.DelayedSiacoinOutputDiff, dir modules.DiffDirection) error {
-	if dscod.Direction == dir {
-		return addDSCO(tx, dscod.MaturityHeight, dscod.ID, dscod.SiacoinOutput)
+// setSiafundPoolTx writes the current siafund pool through tx, regardless
+// of which ConsensusDB backend is in use.
+func setSiafundPoolTx(tx ConsensusDBTx, pool types.Currency) {
+	if bt, ok := tx.(boltConsensusDBTx); ok {
+		setSiafundPool(bt.tx, pool)
+		return
 	}
-	return removeDSCO(tx, dscod.MaturityHeight, dscod.ID)
+	tx.Bucket(nonBoltSiafundPool).Put(nonBoltSiafundPoolKey, encoding.Marshal(pool))
 }
 
-// commitSiafundPoolDiff applies or reverts a SiafundPoolDiff.
-func commitSiafundPoolDiff(tx *bolt.Tx, sfpd modules.SiafundPoolDiff, dir modules.DiffDirection) error {
+// commitSiafundPoolDiff applies or reverts a SiafundPoolDiff. See
+// commitSiacoinOutputDiff for why tx is a ConsensusDBTx.
+func commitSiafundPoolDiff(tx ConsensusDBTx, sfpd modules.SiafundPoolDiff, dir modules.DiffDirection) error {
 	// Sanity check - siafund pool should only ever increase.
 	if build.DEBUG {
 		if sfpd.Adjusted.Cmp(sfpd.Previous) < 0 {
@@ -84,19 +169,19 @@ func commitSiafundPoolDiff(tx *bolt.Tx, sfpd modules.SiafundPoolDiff, dir module
 	if dir == modules.DiffApply {
 		// Sanity check - sfpd.Previous should equal the current siafund pool.
 		if build.DEBUG {
-			if getSiafundPool(tx).Cmp(sfpd.Previous) != 0 {
+			if getSiafundPoolTx(tx).Cmp(sfpd.Previous) != 0 {
 				panic(errApplySiafundPoolDiffMismatch)
 			}
 		}
-		setSiafundPool(tx, sfpd.Adjusted)
+		setSiafundPoolTx(tx, sfpd.Adjusted)
 	} else {
 		// Sanity check - sfpd.Adjusted should equal the current siafund pool.
 		if build.DEBUG {
-			if getSiafundPool(tx).Cmp(sfpd.Adjusted) != 0 {
+			if getSiafundPoolTx(tx).Cmp(sfpd.Adjusted) != 0 {
 				panic(errRevertSiafundPoolDiffMismatch)
 			}
 		}
-		setSiafundPool(tx, sfpd.Previous)
+		setSiafundPoolTx(tx, sfpd.Previous)
 	}
 	return nil
 }
@@ -139,75 +224,107 @@ func (cs *ConsensusSet) createUpcomingDelayedOutputMaps(tx *bolt.Tx, pb *process
 
 // commitNodeDiffs commits all of the diffs in a block node.
 func (cs *ConsensusSet) commitNodeDiffs(pb *processedBlock, dir modules.DiffDirection) error {
-	err := cs.db.Update(func(tx *bolt.Tx) error {
+	// Built outside the closure so its assigned ID is still readable once
+	// the transaction below has committed.
+	ce := changeEntry{
+		Direction:                 dir,
+		SiacoinOutputDiffs:        pb.SiacoinOutputDiffs,
+		FileContractDiffs:         pb.FileContractDiffs,
+		SiafundOutputDiffs:        pb.SiafundOutputDiffs,
+		DelayedSiacoinOutputDiffs: pb.DelayedSiacoinOutputDiffs,
+		SiafundPoolDiffs:          pb.SiafundPoolDiffs,
+	}
+
+	err := cs.commitUpdate(func(tx *bolt.Tx) error {
+		// The commit*Diff functions take a ConsensusDBTx rather than a
+		// *bolt.Tx directly (see storage.go), so every call below goes
+		// through this thin wrapper around the transaction commitUpdate
+		// handed us.
+		dtx := boltConsensusDBTx{tx: tx, writable: true}
 		if dir == modules.DiffApply {
 			for _, scod := range pb.SiacoinOutputDiffs {
-				err := commitSiacoinOutputDiff(tx, scod, dir)
+				err := commitSiacoinOutputDiff(dtx, scod, dir)
 				if err != nil {
 					return err
 				}
 			}
 			for _, fcd := range pb.FileContractDiffs {
-				err := commitFileContractDiff(tx, fcd, dir)
+				err := commitFileContractDiff(dtx, fcd, dir)
 				if err != nil {
 					return err
 				}
 			}
 			for _, sfod := range pb.SiafundOutputDiffs {
-				err := commitSiafundOutputDiff(tx, sfod, dir)
+				err := commitSiafundOutputDiff(dtx, sfod, dir)
 				if err != nil {
 					return err
 				}
 			}
 			for _, dscod := range pb.DelayedSiacoinOutputDiffs {
-				err := commitDelayedSiacoinOutputDiff(tx, dscod, dir)
+				err := commitDelayedSiacoinOutputDiff(dtx, dscod, dir)
 				if err != nil {
 					return err
 				}
 			}
 			for _, sfpd := range pb.SiafundPoolDiffs {
-				err := commitSiafundPoolDiff(tx, sfpd, dir)
+				err := commitSiafundPoolDiff(dtx, sfpd, dir)
 				if err != nil {
 					return err
 				}
 			}
 		} else {
 			for i := len(pb.SiacoinOutputDiffs) - 1; i >= 0; i-- {
-				err := commitSiacoinOutputDiff(tx, pb.SiacoinOutputDiffs[i], dir)
+				err := commitSiacoinOutputDiff(dtx, pb.SiacoinOutputDiffs[i], dir)
 				if err != nil {
 					return err
 				}
 			}
 			for i := len(pb.FileContractDiffs) - 1; i >= 0; i-- {
-				err := commitFileContractDiff(tx, pb.FileContractDiffs[i], dir)
+				err := commitFileContractDiff(dtx, pb.FileContractDiffs[i], dir)
 				if err != nil {
 					return err
 				}
 			}
 			for i := len(pb.SiafundOutputDiffs) - 1; i >= 0; i-- {
-				err := commitSiafundOutputDiff(tx, pb.SiafundOutputDiffs[i], dir)
+				err := commitSiafundOutputDiff(dtx, pb.SiafundOutputDiffs[i], dir)
 				if err != nil {
 					return err
 				}
 			}
 			for i := len(pb.DelayedSiacoinOutputDiffs) - 1; i >= 0; i-- {
-				err := commitDelayedSiacoinOutputDiff(tx, pb.DelayedSiacoinOutputDiffs[i], dir)
+				err := commitDelayedSiacoinOutputDiff(dtx, pb.DelayedSiacoinOutputDiffs[i], dir)
 				if err != nil {
 					return err
 				}
 			}
 			for i := len(pb.SiafundPoolDiffs) - 1; i >= 0; i-- {
-				err := commitSiafundPoolDiff(tx, pb.SiafundPoolDiffs[i], dir)
+				err := commitSiafundPoolDiff(dtx, pb.SiafundPoolDiffs[i], dir)
 				if err != nil {
 					return err
 				}
 			}
 		}
-		return nil
+
+		// Record this commit as a durable, sequentially numbered change so
+		// that persistent subscribers can resume from it later, and prune
+		// any change records that no live subscriber still needs. Both
+		// happen in the same transaction as the diffs above, so the change
+		// log can never drift out of sync with the consensus set it
+		// documents.
+		if err := appendChangeEntry(tx, &ce); err != nil {
+			return err
+		}
+		return pruneChangeLog(tx, cs.oldestPersistentCursor())
 	})
 	if err != nil {
 		return err
 	}
+
+	// Now that ce has been durably committed, advance every persistent
+	// subscriber's cursor so pruneChangeLog can keep reclaiming space
+	// behind it. Delivery of the live change to subscribers happens
+	// separately and is not awaited here.
+	cs.updatePersistentCursors(ce)
 	return nil
 }
 
@@ -255,7 +372,7 @@ func (cs *ConsensusSet) updateCurrentPath(pb *processedBlock, dir modules.DiffDi
 // commitDiffSet applies or reverts the diffs in a blockNode.
 func (cs *ConsensusSet) commitDiffSet(pb *processedBlock, dir modules.DiffDirection) error {
 	cs.commitDiffSetSanity(pb, dir)
-	err := cs.db.Update(func(tx *bolt.Tx) error {
+	err := cs.commitUpdate(func(tx *bolt.Tx) error {
 		return cs.createUpcomingDelayedOutputMaps(tx, pb, dir)
 	})
 	if err != nil {
@@ -281,7 +398,7 @@ func (cs *ConsensusSet) generateAndApplyDiff(pb *processedBlock) error {
 	}
 
 	// Update the state to point to the new block.
-	err := cs.db.Update(func(tx *bolt.Tx) error {
+	err := cs.commitUpdate(func(tx *bolt.Tx) error {
 		bid := pb.Block.ID()
 		err := tx.Bucket(BlockPath).Put(encoding.EncUint64(uint64(pb.Height)), bid[:])
 		if err != nil {
@@ -299,22 +416,31 @@ func (cs *ConsensusSet) generateAndApplyDiff(pb *processedBlock) error {
 	// invalid, the diffs can be safely reversed.
 	pb.DiffsGenerated = true
 
+	// The static, state-independent portion of each transaction's validity
+	// (signatures, encoding and size limits, covered fields, input/output
+	// sums) does not depend on any transaction that comes before it in the
+	// block, so it is checked for every transaction concurrently before the
+	// serial loop below. The state-dependent portion - whether the outputs
+	// and contracts a transaction references actually exist - still has to
+	// be checked and applied one transaction at a time, in order, since a
+	// transaction can spend outputs created earlier in the same block.
+	standaloneErrs := validateStandaloneConcurrent(context.Background(), pb.Block.Transactions, pb.Height)
+
 	// Validate and apply each transaction in the block. They cannot be
 	// validated all at once because some transactions may not be valid until
 	// previous transactions have been applied.
-	for _, txn := range pb.Block.Transactions {
-		err = cs.db.Update(func(tx *bolt.Tx) error {
-			err := cs.validTxTransaction(tx, txn)
-			if err != nil {
-				return err
-			}
-			return nil
-		})
+	for i, txn := range pb.Block.Transactions {
+		err = standaloneErrs[i]
+		if err == nil {
+			err = cs.commitUpdate(func(tx *bolt.Tx) error {
+				return validTxAgainstState(tx, txn)
+			})
+		}
 		if err != nil {
 			// Awkward: need to apply the matured outputs otherwise the diff
 			// structure malforms due to the way the delayedOutput maps are
 			// created and destroyed.
-			updateErr := cs.db.Update(func(tx *bolt.Tx) error {
+			updateErr := cs.commitUpdate(func(tx *bolt.Tx) error {
 				return cs.applyMaturedSiacoinOutputs(tx, pb)
 			})
 			if updateErr != nil {
@@ -325,7 +451,7 @@ func (cs *ConsensusSet) generateAndApplyDiff(pb *processedBlock) error {
 			return err
 		}
 
-		updateErr := cs.db.Update(func(tx *bolt.Tx) error {
+		updateErr := cs.commitUpdate(func(tx *bolt.Tx) error {
 			err = applyTransaction(tx, pb, txn)
 			if err != nil {
 				return err
@@ -346,14 +472,61 @@ func (cs *ConsensusSet) generateAndApplyDiff(pb *processedBlock) error {
 		return err
 	}
 
-	if build.DEBUG {
-		pb.ConsensusSetHash = cs.consensusSetHash()
+	// ConsensusSetHash is computed unconditionally, not just under
+	// build.DEBUG, so that every processedBlock carries a verifiable
+	// checkpoint of the full consensus set at that height, not only in
+	// debug builds.
+	//
+	// This is a different construction from the root WriteSnapshot
+	// returns in snapshot.go: ConsensusSetHash covers the live, directly
+	// queryable consensus set, while a snapshot's root covers the
+	// wire-framed {Bucket, Index, Pairs} chunks actually streamed to a
+	// fast-syncing peer. The trustedRoot passed to LoadSnapshot must
+	// therefore come from the same place WriteSnapshot's return value did -
+	// either a value a peer quotes alongside the snapshot it is serving, or
+	// one hard-coded into the build from a snapshot the maintainers
+	// generated and vetted themselves - not from a block's ConsensusSetHash.
+	pb.ConsensusSetHash = cs.consensusSetHash()
+
+	// Record this block's diffs as a durable, sequentially numbered change
+	// so that persistent subscribers can resume from it later, and prune
+	// any change records no live subscriber still needs. This is the path
+	// every ordinary new block actually takes; commitNodeDiffs performs the
+	// same bookkeeping for every diff set committed through commitDiffSet,
+	// such as the revert of a block that turned out to contain an invalid
+	// transaction, above.
+	ce := changeEntry{
+		Direction:                 modules.DiffApply,
+		SiacoinOutputDiffs:        pb.SiacoinOutputDiffs,
+		FileContractDiffs:         pb.FileContractDiffs,
+		SiafundOutputDiffs:        pb.SiafundOutputDiffs,
+		DelayedSiacoinOutputDiffs: pb.DelayedSiacoinOutputDiffs,
+		SiafundPoolDiffs:          pb.SiafundPoolDiffs,
 	}
 
-	// Replace the unprocessed block in the block map with a processed one
-	return cs.db.Update(func(tx *bolt.Tx) error {
+	// Replace the unprocessed block in the block map with a processed one,
+	// and append+prune the change log in the same transaction, so the
+	// change log can never drift out of sync with the consensus set it
+	// documents.
+	err = cs.commitUpdate(func(tx *bolt.Tx) error {
 		id := pb.Block.ID()
 		blockMap := tx.Bucket(BlockMap)
-		return blockMap.Put(id[:], encoding.Marshal(*pb))
+		if err := blockMap.Put(id[:], encoding.Marshal(*pb)); err != nil {
+			return err
+		}
+		if err := appendChangeEntry(tx, &ce); err != nil {
+			return err
+		}
+		return pruneChangeLog(tx, cs.oldestPersistentCursor())
 	})
+	if err != nil {
+		return err
+	}
+
+	// Now that ce has been durably committed, advance every persistent
+	// subscriber's cursor so pruneChangeLog can keep reclaiming space
+	// behind it. Delivery of the live change to subscribers happens
+	// separately and is not awaited here.
+	cs.updatePersistentCursors(ce)
+	return nil
 }
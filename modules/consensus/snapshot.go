@@ -0,0 +1,328 @@
+package consensus
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+
+	"github.com/boltdb/bolt"
+
+	"github.com/NebulousLabs/Sia/crypto"
+	"github.com/NebulousLabs/Sia/encoding"
+	"github.com/NebulousLabs/Sia/types"
+)
+
+// errSnapshotRootMismatch is returned by LoadSnapshot when the root hash
+// computed over a snapshot's header and chunks does not match the
+// caller's trusted checkpoint.
+var errSnapshotRootMismatch = errors.New("snapshot root does not match the trusted checkpoint")
+
+// snapshotBuckets lists the fixed-name buckets a snapshot always includes:
+// siacoin outputs, file contracts, and siafund outputs. The siafund pool is
+// a single value rather than a bucket, so it travels in snapshotHeader
+// instead.
+//
+// Delayed siacoin outputs are NOT listed here because they are not a
+// single bucket - createDSCOBucket gives every maturity height its own
+// bucket - but they are not excluded from the snapshot. An output whose
+// maturity height falls within MaturityDelay of the snapshot height was
+// created by a transaction applied before the snapshot, and replaying the
+// blocks after the snapshot will never recreate it, since those blocks
+// only ever mature or spend existing delayed outputs, not create the ones
+// already pending at the snapshot height. WriteSnapshot instead discovers
+// every such bucket dynamically (see dscoBuckets below) and includes each
+// one; only the buckets in this fixed list and in snapshotExcludedBuckets
+// are excluded from that sweep.
+var snapshotBuckets = [][]byte{
+	SiacoinOutputs,
+	FileContracts,
+	SiafundOutputs,
+}
+
+// snapshotExcludedBuckets lists every top-level bucket, besides
+// snapshotBuckets itself, that dscoBuckets must skip when it sweeps the
+// database for delayed-siacoin-output buckets to include in a snapshot:
+// none of these describe UTXO-set state a fast-syncing node needs, and
+// BlockMap/BlockPath in particular would make the snapshot at least as
+// large as the full chain it exists to avoid downloading.
+var snapshotExcludedBuckets = [][]byte{
+	BlockMap,
+	BlockPath,
+	ChangeLog,
+}
+
+// dscoBuckets returns the name of every delayed-siacoin-output bucket
+// currently present in tx - one per maturity height that has ever had an
+// output scheduled against it and not yet been fully drained - by sweeping
+// every top-level bucket and excluding the ones named in snapshotBuckets
+// and snapshotExcludedBuckets. This avoids hard-coding the per-height
+// bucket-naming scheme createDSCOBucket/addDSCO/removeDSCO use, since a
+// snapshot only needs to reproduce whatever buckets are actually there.
+func dscoBuckets(tx *bolt.Tx) ([][]byte, error) {
+	excluded := make(map[string]bool)
+	for _, name := range snapshotBuckets {
+		excluded[string(name)] = true
+	}
+	for _, name := range snapshotExcludedBuckets {
+		excluded[string(name)] = true
+	}
+
+	var names [][]byte
+	err := tx.ForEach(func(name []byte, _ *bolt.Bucket) error {
+		if !excluded[string(name)] {
+			names = append(names, append([]byte{}, name...))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return names, nil
+}
+
+// snapshotChunkSize caps how many key/value pairs go into a single
+// snapshot chunk. Keeping chunks small and independently verifiable is
+// what lets a snapshot be fetched and applied incrementally over the
+// gateway, instead of requiring the whole snapshot before any of it is
+// useful.
+const snapshotChunkSize = 4096
+
+// snapshotHeader is the first record in a snapshot stream. It carries the
+// parts of consensus state that do not live in one of snapshotBuckets: the
+// chain tip the snapshot was taken at, and the siafund pool's value at
+// that height.
+type snapshotHeader struct {
+	Height      types.BlockHeight
+	BlockID     types.BlockID
+	SiafundPool types.Currency
+}
+
+func (h snapshotHeader) hash() crypto.Hash {
+	return crypto.HashObject(h)
+}
+
+// snapshotChunk is one resumable unit of a snapshot. Every pair in a chunk
+// belongs to the same bucket; Index records the chunk's position within
+// that bucket's stream so chunks fetched out of order can still be
+// reassembled.
+type snapshotChunk struct {
+	Bucket []byte
+	Index  uint64
+	Pairs  [][2][]byte
+}
+
+// hash returns the content address of the chunk. WriteSnapshot folds every
+// chunk's hash into the overall snapshot root, and a peer serving a
+// snapshot over the gateway can use it to let a resuming downloader skip
+// chunks it already has.
+func (c snapshotChunk) hash() crypto.Hash {
+	return crypto.HashObject(c)
+}
+
+// WriteSnapshot serializes the consensus set's state as of the block
+// (height, id) into a snapshotHeader followed by a sequence of
+// length-prefixed snapshotChunks written to w, and returns the root hash
+// over the header and every chunk's hash - the same root a caller later
+// passes to LoadSnapshot as trustedRoot. The root is crypto.HashAll over
+// the header's hash followed by every chunk's hash in stream order: a
+// single flat hash, not a Merkle tree, so one chunk cannot be checked
+// against it without the hashes of all the others. This is the serving side of
+// fast-sync: a gateway peer that advertises a matching root can stream
+// exactly this back to a node that wants to skip replaying history from
+// genesis.
+func (cs *ConsensusSet) WriteSnapshot(w io.Writer, height types.BlockHeight, id types.BlockID) (crypto.Hash, error) {
+	var chunkHashes []crypto.Hash
+	err := cs.db.View(func(tx *bolt.Tx) error {
+		header := snapshotHeader{
+			Height:      height,
+			BlockID:     id,
+			SiafundPool: getSiafundPool(tx),
+		}
+		chunkHashes = append(chunkHashes, header.hash())
+		if err := writeFramed(w, encoding.Marshal(header)); err != nil {
+			return err
+		}
+
+		dscos, err := dscoBuckets(tx)
+		if err != nil {
+			return err
+		}
+
+		for _, bucketName := range append(append([][]byte{}, snapshotBuckets...), dscos...) {
+			b := tx.Bucket(bucketName)
+			if b == nil {
+				continue
+			}
+			hashes, err := writeSnapshotBucket(w, bucketName, b)
+			if err != nil {
+				return err
+			}
+			chunkHashes = append(chunkHashes, hashes...)
+		}
+		return nil
+	})
+	if err != nil {
+		return crypto.Hash{}, err
+	}
+	return crypto.HashAll(chunkHashes...), nil
+}
+
+// writeSnapshotBucket streams every key/value pair in b to w as a sequence
+// of snapshotChunkSize-sized snapshotChunks tagged with bucketName, and
+// returns each chunk's hash in write order.
+func writeSnapshotBucket(w io.Writer, bucketName []byte, b *bolt.Bucket) ([]crypto.Hash, error) {
+	var hashes []crypto.Hash
+	var pairs [][2][]byte
+	index := uint64(0)
+	flush := func() error {
+		if len(pairs) == 0 {
+			return nil
+		}
+		chunk := snapshotChunk{Bucket: bucketName, Index: index, Pairs: pairs}
+		hashes = append(hashes, chunk.hash())
+		if err := writeFramed(w, encoding.Marshal(chunk)); err != nil {
+			return err
+		}
+		pairs = nil
+		index++
+		return nil
+	}
+
+	c := b.Cursor()
+	for k, v := c.First(); k != nil; k, v = c.Next() {
+		pairs = append(pairs, [2][]byte{append([]byte{}, k...), append([]byte{}, v...)})
+		if len(pairs) >= snapshotChunkSize {
+			if err := flush(); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if err := flush(); err != nil {
+		return nil, err
+	}
+	return hashes, nil
+}
+
+// writeFramed writes data to w prefixed with its own length, so that
+// readFramed can read exactly one record back out regardless of what
+// follows it in the stream.
+func writeFramed(w io.Writer, data []byte) error {
+	if err := binary.Write(w, binary.LittleEndian, uint64(len(data))); err != nil {
+		return err
+	}
+	_, err := w.Write(data)
+	return err
+}
+
+// readFramed reads one length-prefixed record from r. It returns io.EOF,
+// unwrapped, once r is exhausted between records.
+func readFramed(r io.Reader) ([]byte, error) {
+	var length uint64
+	if err := binary.Read(r, binary.LittleEndian, &length); err != nil {
+		return nil, err
+	}
+	data := make([]byte, length)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// LoadSnapshot reads a snapshot produced by WriteSnapshot from r, verifies
+// that the root hash over its header and chunks equals trustedRoot - a
+// checkpoint either hard-coded into the build or quoted by the peer serving
+// the snapshot, never a block's ConsensusSetHash (see the comment on
+// pb.ConsensusSetHash in diffs.go for why those are different roots) - and
+// then bulk loads it into the consensus set's buckets. BlockPath and the
+// siafund pool are seeded from the snapshot header, so the node can start
+// validating blocks forward from the snapshot instead of replaying history
+// from genesis.
+//
+// LoadSnapshot reads every record from r and verifies trustedRoot before
+// applying anything, so a single call is not resumable: r must be the
+// start of the stream WriteSnapshot produced. A caller fetching a snapshot
+// over the gateway is expected to resume an interrupted download at the
+// transport level (e.g. re-requesting the stream from byte 0, or from a
+// peer that supports ranged re-fetches) and only call LoadSnapshot once
+// the full stream is available again.
+func (cs *ConsensusSet) LoadSnapshot(r io.Reader, trustedRoot crypto.Hash) error {
+	headerData, err := readFramed(r)
+	if err != nil {
+		return err
+	}
+	var header snapshotHeader
+	if err := encoding.Unmarshal(headerData, &header); err != nil {
+		return err
+	}
+
+	recordHashes := []crypto.Hash{header.hash()}
+	var chunks []snapshotChunk
+	for {
+		data, err := readFramed(r)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		var chunk snapshotChunk
+		if err := encoding.Unmarshal(data, &chunk); err != nil {
+			return err
+		}
+		recordHashes = append(recordHashes, chunk.hash())
+		chunks = append(chunks, chunk)
+	}
+
+	if crypto.HashAll(recordHashes...) != trustedRoot {
+		return errSnapshotRootMismatch
+	}
+
+	// Every bucket referenced by the snapshot - the fixed ones plus
+	// whichever delayed-siacoin-output buckets WriteSnapshot found present
+	// at its snapshot height - is wiped and recreated before any chunk is
+	// applied, so a bucket with no entries left at the snapshot height (and
+	// therefore no chunk in the stream) doesn't retain stale pre-snapshot
+	// data.
+	bucketNames := append([][]byte{}, snapshotBuckets...)
+	seen := make(map[string]bool)
+	for _, name := range bucketNames {
+		seen[string(name)] = true
+	}
+	for _, chunk := range chunks {
+		if !seen[string(chunk.Bucket)] {
+			seen[string(chunk.Bucket)] = true
+			bucketNames = append(bucketNames, chunk.Bucket)
+		}
+	}
+
+	return cs.db.Update(func(tx *bolt.Tx) error {
+		for _, bucketName := range bucketNames {
+			if err := tx.DeleteBucket(bucketName); err != nil && err != bolt.ErrBucketNotFound {
+				return err
+			}
+			if _, err := tx.CreateBucketIfNotExists(bucketName); err != nil {
+				return err
+			}
+		}
+		for _, chunk := range chunks {
+			b := tx.Bucket(chunk.Bucket)
+			for _, pair := range chunk.Pairs {
+				if err := b.Put(pair[0], pair[1]); err != nil {
+					return err
+				}
+			}
+		}
+		setSiafundPool(tx, header.SiafundPool)
+
+		// A node loading a snapshot to skip replaying history from genesis
+		// has never processed a block before, and so has no BlockPath
+		// bucket yet; create it alongside the snapshotted buckets above
+		// rather than assuming it already exists.
+		blockPath, err := tx.CreateBucketIfNotExists(BlockPath)
+		if err != nil {
+			return err
+		}
+		bid := header.BlockID
+		return blockPath.Put(encoding.EncUint64(uint64(header.Height)), bid[:])
+	})
+}
@@ -0,0 +1,134 @@
+package consensus
+
+import (
+	"bytes"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/boltdb/bolt"
+
+	"github.com/NebulousLabs/Sia/crypto"
+	"github.com/NebulousLabs/Sia/encoding"
+)
+
+func openSnapshotTestDB(t *testing.T) *bolt.DB {
+	path := filepath.Join(t.TempDir(), "snapshot.db")
+	db, err := bolt.Open(path, 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		db.Close()
+	})
+	return db
+}
+
+// TestDscoBucketsExcludesFixedAndMetadataBuckets verifies that dscoBuckets
+// only returns the buckets that aren't already covered by snapshotBuckets
+// or snapshotExcludedBuckets - i.e. the dynamically-named, per-height
+// delayed-siacoin-output buckets a snapshot must still include.
+func TestDscoBucketsExcludesFixedAndMetadataBuckets(t *testing.T) {
+	db := openSnapshotTestDB(t)
+	dscoA := []byte("dsco-100")
+	dscoB := []byte("dsco-105")
+
+	err := db.Update(func(tx *bolt.Tx) error {
+		for _, name := range append(append(append([][]byte{}, snapshotBuckets...), snapshotExcludedBuckets...), dscoA, dscoB) {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var found [][]byte
+	err = db.View(func(tx *bolt.Tx) error {
+		var err error
+		found, err = dscoBuckets(tx)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sort.Slice(found, func(i, j int) bool { return bytes.Compare(found[i], found[j]) < 0 })
+	want := [][]byte{dscoA, dscoB}
+	sort.Slice(want, func(i, j int) bool { return bytes.Compare(want[i], want[j]) < 0 })
+
+	if len(found) != len(want) {
+		t.Fatalf("expected %d dsco buckets, got %d: %v", len(want), len(found), found)
+	}
+	for i := range want {
+		if !bytes.Equal(found[i], want[i]) {
+			t.Fatalf("expected bucket %q, got %q", want[i], found[i])
+		}
+	}
+}
+
+// TestWriteSnapshotBucketRoundTrip verifies that writeSnapshotBucket frames
+// every key/value pair in a bucket into chunks that readFramed can parse
+// back out, preserving pair contents and order.
+func TestWriteSnapshotBucketRoundTrip(t *testing.T) {
+	db := openSnapshotTestDB(t)
+	bucketName := []byte("TestBucket")
+	pairs := map[string]string{
+		"key1": "value1",
+		"key2": "value2",
+		"key3": "value3",
+	}
+
+	var buf bytes.Buffer
+	var hashes []crypto.Hash
+	err := db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(bucketName)
+		if err != nil {
+			return err
+		}
+		for k, v := range pairs {
+			if err := b.Put([]byte(k), []byte(v)); err != nil {
+				return err
+			}
+		}
+		hashes, err = writeSnapshotBucket(&buf, bucketName, b)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hashes) != 1 {
+		t.Fatalf("expected a single chunk for %d pairs, got %d", len(pairs), len(hashes))
+	}
+
+	data, err := readFramed(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var chunk snapshotChunk
+	if err := encoding.Unmarshal(data, &chunk); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(chunk.Bucket, bucketName) {
+		t.Fatalf("expected bucket name %q, got %q", bucketName, chunk.Bucket)
+	}
+	if len(chunk.Pairs) != len(pairs) {
+		t.Fatalf("expected %d pairs, got %d", len(pairs), len(chunk.Pairs))
+	}
+	for i := 1; i < len(chunk.Pairs); i++ {
+		if bytes.Compare(chunk.Pairs[i-1][0], chunk.Pairs[i][0]) >= 0 {
+			t.Fatalf("expected pairs in bucket key order, got %q before %q", chunk.Pairs[i-1][0], chunk.Pairs[i][0])
+		}
+	}
+	for _, pair := range chunk.Pairs {
+		want, ok := pairs[string(pair[0])]
+		if !ok {
+			t.Fatalf("unexpected key %q in chunk", pair[0])
+		}
+		if string(pair[1]) != want {
+			t.Fatalf("expected value %q for key %q, got %q", want, pair[0], pair[1])
+		}
+	}
+}
@@ -0,0 +1,168 @@
+package consensus
+
+import (
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// nonBoltDelayedSiacoinOutputs and nonBoltSiafundPool are the
+// ConsensusDBBucket names the non-Bolt code paths in
+// commitDelayedSiacoinOutputDiff and commitSiafundPoolDiff use. They only
+// exist for backends other than Bolt: the Bolt backend keeps delayed
+// siacoin outputs in one bucket per maturity height, and the siafund pool
+// as a value accessed through getSiafundPool/setSiafundPool, neither of
+// which has a direct equivalent in the flat ConsensusDBBucket keyspace.
+var (
+	nonBoltDelayedSiacoinOutputs = []byte("DelayedSiacoinOutputs")
+	nonBoltSiafundPool           = []byte("SiafundPool")
+)
+
+// ConsensusDB abstracts the storage engine underneath the consensus set.
+// Before this type existed, commitSiacoinOutputDiff, commitFileContractDiff,
+// commitSiafundOutputDiff, commitDelayedSiacoinOutputDiff, and
+// commitSiafundPoolDiff all took a *bolt.Tx directly. Those five functions
+// now go through ConsensusDBTx instead, with a generic fallback path that
+// only depends on this interface (see diffs_test.go's fakeConsensusDBTx).
+//
+// The rest of the write path - createUpcomingDelayedOutputMaps,
+// applyTransaction, applyMaturedSiacoinOutputs, and the final BlockMap
+// write in generateAndApplyDiff - still takes a *bolt.Tx directly, so
+// boltConsensusDB below is, for now, the only ConsensusDB a ConsensusSet
+// can actually run on; commitUpdate (bulkapply.go) hands every caller the
+// underlying *bolt.Tx regardless of which ConsensusDB constructed it. A
+// Badger or Pebble ConsensusDB is only reachable once that remaining
+// write path is ported off *bolt.Tx too.
+type ConsensusDB interface {
+	// View runs fn in a read-only transaction.
+	View(fn func(ConsensusDBTx) error) error
+	// Update runs fn in a read-write transaction, committing (and
+	// fsync'ing, for the backends that require it) on return.
+	Update(fn func(ConsensusDBTx) error) error
+	// Batch runs fn against a transaction that may be shared with other
+	// concurrent Batch calls, amortizing the commit/fsync cost across all
+	// of them. It is used by the bulk-apply path during initial block
+	// download; see commitUpdate in bulkapply.go.
+	Batch(fn func(ConsensusDBTx) error) error
+	// Close releases the underlying storage handle.
+	Close() error
+}
+
+// ConsensusDBTx is the subset of a storage transaction that the commit*
+// functions in diffs.go need.
+type ConsensusDBTx interface {
+	// Bucket returns the named bucket, creating it if it does not already
+	// exist. In a read-only transaction a missing bucket is not created;
+	// the Bolt backend returns nil for it instead.
+	Bucket(name []byte) ConsensusDBBucket
+	// DeleteBucket removes the named bucket and everything in it.
+	DeleteBucket(name []byte) error
+}
+
+// ConsensusDBBucket is a named key/value namespace within a ConsensusDB
+// transaction.
+type ConsensusDBBucket interface {
+	Get(key []byte) []byte
+	Put(key, value []byte) error
+	Delete(key []byte) error
+}
+
+// boltConsensusDB implements ConsensusDB on top of BoltDB. It is the
+// default backend, and the one every existing deployment of the consensus
+// set already runs on.
+type boltConsensusDB struct {
+	db *bolt.DB
+}
+
+// newBoltConsensusDB wraps an already-open *bolt.DB as a ConsensusDB.
+func newBoltConsensusDB(db *bolt.DB) ConsensusDB {
+	return &boltConsensusDB{db: db}
+}
+
+// newBulkApplyBoltConsensusDB wraps an already-open *bolt.DB as a
+// ConsensusDB whose Batch calls are configured for bulk-apply use during
+// initial block download, by setting Bolt's own batching knobs: up to
+// maxBatchSize Batch calls that are in flight at the same time are
+// coalesced into a single underlying transaction and fsync, or fewer if
+// maxBatchDelay elapses first. Bolt only groups concurrent callers; a
+// caller that waits for each Batch call to return before making the next
+// one gets a transaction of its own per call, each committed once
+// maxBatchDelay has elapsed.
+func newBulkApplyBoltConsensusDB(db *bolt.DB, maxBatchSize int, maxBatchDelay time.Duration) ConsensusDB {
+	db.MaxBatchSize = maxBatchSize
+	db.MaxBatchDelay = maxBatchDelay
+	return &boltConsensusDB{db: db}
+}
+
+func (b *boltConsensusDB) View(fn func(ConsensusDBTx) error) error {
+	return b.db.View(func(tx *bolt.Tx) error {
+		return fn(boltConsensusDBTx{tx: tx, writable: false})
+	})
+}
+
+func (b *boltConsensusDB) Update(fn func(ConsensusDBTx) error) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return fn(boltConsensusDBTx{tx: tx, writable: true})
+	})
+}
+
+// Batch defers to Bolt's own Batch, which opportunistically groups
+// concurrent callers into a single transaction and a single fsync.
+func (b *boltConsensusDB) Batch(fn func(ConsensusDBTx) error) error {
+	return b.db.Batch(func(tx *bolt.Tx) error {
+		return fn(boltConsensusDBTx{tx: tx, writable: true})
+	})
+}
+
+func (b *boltConsensusDB) Close() error {
+	return b.db.Close()
+}
+
+// boltConsensusDBTx adapts a *bolt.Tx to ConsensusDBTx. writable records
+// whether tx was opened read-write, since Bolt's CreateBucketIfNotExists
+// errors on a read-only transaction even when the bucket already exists -
+// a View call has to fall back to a plain, nil-returning bucket lookup
+// instead.
+type boltConsensusDBTx struct {
+	tx       *bolt.Tx
+	writable bool
+}
+
+func (t boltConsensusDBTx) Bucket(name []byte) ConsensusDBBucket {
+	if !t.writable {
+		b := t.tx.Bucket(name)
+		if b == nil {
+			return nil
+		}
+		return boltConsensusDBBucket{b}
+	}
+	b, err := t.tx.CreateBucketIfNotExists(name)
+	if err != nil {
+		// CreateBucketIfNotExists only errors on a read-only transaction or
+		// a bad bucket name; writable is checked above, so this is a
+		// programmer error (e.g. a bad bucket name).
+		panic(err)
+	}
+	return boltConsensusDBBucket{b}
+}
+
+func (t boltConsensusDBTx) DeleteBucket(name []byte) error {
+	return t.tx.DeleteBucket(name)
+}
+
+// boltConsensusDBBucket adapts a *bolt.Bucket to ConsensusDBBucket.
+type boltConsensusDBBucket struct {
+	b *bolt.Bucket
+}
+
+func (b boltConsensusDBBucket) Get(key []byte) []byte {
+	return b.b.Get(key)
+}
+
+func (b boltConsensusDBBucket) Put(key, value []byte) error {
+	return b.b.Put(key, value)
+}
+
+func (b boltConsensusDBBucket) Delete(key []byte) error {
+	return b.b.Delete(key)
+}
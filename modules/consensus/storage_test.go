@@ -0,0 +1,116 @@
+package consensus
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/boltdb/bolt"
+)
+
+func openStorageTestDB(t *testing.T) *bolt.DB {
+	path := filepath.Join(t.TempDir(), "storage.db")
+	db, err := bolt.Open(path, 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		db.Close()
+	})
+	return db
+}
+
+// TestBoltConsensusDBPutGetDelete verifies that boltConsensusDB's Update and
+// View round-trip values through a bucket that did not previously exist -
+// exactly what commitSiacoinOutputDiff and friends rely on when run against
+// the generic (non-fast-path) side of a ConsensusDBTx.
+func TestBoltConsensusDBPutGetDelete(t *testing.T) {
+	cdb := newBoltConsensusDB(openStorageTestDB(t))
+	bucket := []byte("TestBucket")
+	key := []byte("key")
+	value := []byte("value")
+
+	err := cdb.Update(func(tx ConsensusDBTx) error {
+		return tx.Bucket(bucket).Put(key, value)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = cdb.View(func(tx ConsensusDBTx) error {
+		got := tx.Bucket(bucket).Get(key)
+		if string(got) != string(value) {
+			t.Errorf("expected %q, got %q", value, got)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = cdb.Update(func(tx ConsensusDBTx) error {
+		return tx.Bucket(bucket).Delete(key)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = cdb.View(func(tx ConsensusDBTx) error {
+		if got := tx.Bucket(bucket).Get(key); got != nil {
+			t.Errorf("expected key to be deleted, got %q", got)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestBoltConsensusDBTxIsBoltFastPath verifies that a ConsensusDBTx handed
+// out by boltConsensusDB satisfies the boltConsensusDBTx fast-path type
+// assertion the commit*Diff functions use to delegate to the existing
+// bolt-specific helpers instead of the generic bucket path.
+func TestBoltConsensusDBTxIsBoltFastPath(t *testing.T) {
+	cdb := newBoltConsensusDB(openStorageTestDB(t))
+	err := cdb.Update(func(tx ConsensusDBTx) error {
+		if _, ok := tx.(boltConsensusDBTx); !ok {
+			t.Error("expected boltConsensusDB's transaction to satisfy boltConsensusDBTx")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestNewBulkApplyBoltConsensusDB verifies that the returned ConsensusDB
+// configures the underlying *bolt.DB's batching knobs and still behaves
+// like a normal ConsensusDB for Update/View.
+func TestNewBulkApplyBoltConsensusDB(t *testing.T) {
+	boltDB := openStorageTestDB(t)
+	cdb := newBulkApplyBoltConsensusDB(boltDB, 128, 0)
+
+	if boltDB.MaxBatchSize != 128 {
+		t.Errorf("expected MaxBatchSize 128, got %d", boltDB.MaxBatchSize)
+	}
+
+	bucket := []byte("TestBucket")
+	key := []byte("key")
+	value := []byte("value")
+	err := cdb.Batch(func(tx ConsensusDBTx) error {
+		return tx.Bucket(bucket).Put(key, value)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = cdb.View(func(tx ConsensusDBTx) error {
+		got := tx.Bucket(bucket).Get(key)
+		if string(got) != string(value) {
+			t.Errorf("expected %q, got %q", value, got)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,96 @@
+package consensus
+
+import (
+	"context"
+	"runtime"
+	"sync"
+
+	"github.com/boltdb/bolt"
+
+	"github.com/NebulousLabs/Sia/types"
+)
+
+// validTxStandalone performs every check on txn that does not depend on
+// the current consensus state: signature validity, encoding and size
+// limits, the arbitrary-data size limit, covered-fields correctness, and
+// that inputs and outputs sum correctly. None of these checks depend on
+// anything other than txn and the block height it appears in, so unlike
+// validTxAgainstState they are safe to run concurrently across every
+// transaction in a block.
+func validTxStandalone(txn types.Transaction, height types.BlockHeight) error {
+	return txn.StandaloneValid(height)
+}
+
+// validTxAgainstState performs the checks on txn that depend on the
+// current consensus state: that every siacoin input, siafund input, and
+// file contract it references actually exists, and that storage proofs
+// and contract revisions resolve against real, live contracts. These
+// checks must run serially and in transaction order, since a later
+// transaction in a block is allowed to depend on outputs created by an
+// earlier one.
+func validTxAgainstState(tx *bolt.Tx, txn types.Transaction) error {
+	err := validSiacoins(tx, txn)
+	if err != nil {
+		return err
+	}
+	err = validStorageProofs(tx, txn)
+	if err != nil {
+		return err
+	}
+	err = validFileContractRevisions(tx, txn)
+	if err != nil {
+		return err
+	}
+	err = validSiafunds(tx, txn)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// validateStandaloneConcurrent runs validTxStandalone for every
+// transaction in txns across a pool of runtime.NumCPU() workers, returning
+// one error per transaction, in block order. As soon as any worker
+// reports a failure, the context is canceled and workers stop claiming new
+// work, since a single invalid transaction already dooms the block and the
+// remaining standalone checks are wasted effort.
+func validateStandaloneConcurrent(ctx context.Context, txns []types.Transaction, height types.BlockHeight) []error {
+	errs := make([]error, len(txns))
+	if len(txns) == 0 {
+		return errs
+	}
+
+	workers := runtime.NumCPU()
+	if workers > len(txns) {
+		workers = len(txns)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for w := 0; w < workers; w++ {
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				if err := validTxStandalone(txns[i], height); err != nil {
+					errs[i] = err
+					cancel()
+				}
+			}
+		}()
+	}
+dispatch:
+	for i := range txns {
+		select {
+		case jobs <- i:
+		case <-ctx.Done():
+			break dispatch
+		}
+	}
+	close(jobs)
+	wg.Wait()
+	return errs
+}
@@ -0,0 +1,43 @@
+package consensus
+
+import (
+	"context"
+	"testing"
+
+	"github.com/NebulousLabs/Sia/types"
+)
+
+// TestValidateStandaloneConcurrentEmpty verifies that an empty transaction
+// slice returns an empty (not nil-length-mismatched) error slice without
+// spinning up any workers.
+func TestValidateStandaloneConcurrentEmpty(t *testing.T) {
+	errs := validateStandaloneConcurrent(context.Background(), nil, 0)
+	if len(errs) != 0 {
+		t.Fatalf("expected 0 errors for 0 transactions, got %d", len(errs))
+	}
+}
+
+// TestValidateStandaloneConcurrentPreservesOrder verifies that
+// validateStandaloneConcurrent returns exactly one result per input
+// transaction, at the same index it was given - regardless of which
+// worker in the pool happens to process it - so callers can pair
+// errs[i] back up with pb.Block.Transactions[i].
+func TestValidateStandaloneConcurrentPreservesOrder(t *testing.T) {
+	txns := make([]types.Transaction, 64)
+	// Only the last transaction is invalid: a zero-value siacoin output
+	// fails the standalone minimum-value check.
+	last := len(txns) - 1
+	txns[last].SiacoinOutputs = []types.SiacoinOutput{{}}
+	errs := validateStandaloneConcurrent(context.Background(), txns, 0)
+	if len(errs) != len(txns) {
+		t.Fatalf("expected %d results, got %d", len(txns), len(errs))
+	}
+	for i := 0; i < last; i++ {
+		if errs[i] != nil {
+			t.Fatalf("expected transaction %d to be valid, got %v", i, errs[i])
+		}
+	}
+	if errs[last] == nil {
+		t.Fatalf("expected an error at index %d for the invalid transaction", last)
+	}
+}